@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package monitoring provides helpers, shared by the Stackdriver-related
+// e2e suites, for validating that Stackdriver metric descriptors still
+// match the schema the suites were written against and for reading typed
+// values back out of TimeSeries points.
+package monitoring
+
+import (
+	"fmt"
+	"strings"
+
+	gcm "google.golang.org/api/monitoring/v3"
+)
+
+// MetricSchema describes the MetricKind, ValueType and Unit a metric
+// descriptor is expected to have.
+type MetricSchema struct {
+	MetricKind string
+	ValueType  string
+	Unit       string
+}
+
+// ExpectedSchemas is the table of expected descriptor schemas for the
+// built-in Stackdriver container metrics the e2e suite polls for, as
+// described here: https://cloud.google.com/monitoring/api/metrics#gcp-container
+var ExpectedSchemas = map[string]MetricSchema{
+	"container.googleapis.com/container/uptime":                  {MetricKind: "CUMULATIVE", ValueType: "DOUBLE", Unit: "s"},
+	"container.googleapis.com/container/memory/bytes_total":      {MetricKind: "GAUGE", ValueType: "INT64", Unit: "By"},
+	"container.googleapis.com/container/memory/bytes_used":       {MetricKind: "GAUGE", ValueType: "INT64", Unit: "By"},
+	"container.googleapis.com/container/cpu/reserved_cores":      {MetricKind: "GAUGE", ValueType: "DOUBLE", Unit: "{cpu}"},
+	"container.googleapis.com/container/cpu/usage_time":          {MetricKind: "CUMULATIVE", ValueType: "DOUBLE", Unit: "s"},
+	"container.googleapis.com/container/memory/page_fault_count": {MetricKind: "CUMULATIVE", ValueType: "INT64", Unit: "1"},
+	"container.googleapis.com/container/disk/bytes_used":         {MetricKind: "GAUGE", ValueType: "INT64", Unit: "By"},
+	"container.googleapis.com/container/disk/bytes_total":        {MetricKind: "GAUGE", ValueType: "INT64", Unit: "By"},
+	"container.googleapis.com/container/cpu/utilization":         {MetricKind: "GAUGE", ValueType: "DOUBLE", Unit: "10^2.%"},
+}
+
+// ValidateMetricDescriptors fetches the MetricDescriptor for every
+// metricType that has an entry in ExpectedSchemas and checks its
+// MetricKind, ValueType and Unit against it. metricTypes without a known
+// schema are skipped. It returns a single error listing every descriptor
+// that is missing or has drifted from its expected schema.
+//
+// Callers polling metrics that are also exercised elsewhere in the suite
+// should treat this as diagnostic rather than fatal until ExpectedSchemas
+// has been cross-checked against the live API for every entry: a stale
+// Unit or ValueType here shouldn't take down an otherwise-passing test.
+func ValidateMetricDescriptors(gcmService *gcm.Service, projectId string, metricTypes []string) error {
+	var errs []string
+	for _, metricType := range metricTypes {
+		want, ok := ExpectedSchemas[metricType]
+		if !ok {
+			continue
+		}
+		descriptor, err := gcmService.Projects.MetricDescriptors.
+			Get(fmt.Sprintf("projects/%s/metricDescriptors/%s", projectId, metricType)).
+			Do()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: descriptor not found: %v", metricType, err))
+			continue
+		}
+		if descriptor.MetricKind != want.MetricKind {
+			errs = append(errs, fmt.Sprintf("%s: got MetricKind %q, want %q", metricType, descriptor.MetricKind, want.MetricKind))
+		}
+		if descriptor.ValueType != want.ValueType {
+			errs = append(errs, fmt.Sprintf("%s: got ValueType %q, want %q", metricType, descriptor.ValueType, want.ValueType))
+		}
+		if descriptor.Unit != want.Unit {
+			errs = append(errs, fmt.Sprintf("%s: got Unit %q, want %q", metricType, descriptor.Unit, want.Unit))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("metric descriptor schema validation failed:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// PointValue extracts a float64 out of a TimeSeries point, dispatching on
+// the owning descriptor's ValueType instead of assuming DOUBLE. DISTRIBUTION
+// points are reduced to their Mean. Points returned through
+// DistributionMeanAggregation are already DOUBLE and are read as such.
+func PointValue(valueType string, point *gcm.Point) (float64, error) {
+	switch valueType {
+	case "DOUBLE":
+		return *point.Value.DoubleValue, nil
+	case "INT64":
+		return float64(*point.Value.Int64Value), nil
+	case "DISTRIBUTION":
+		return point.Value.DistributionValue.Mean, nil
+	default:
+		return 0, fmt.Errorf("unsupported metric ValueType %q", valueType)
+	}
+}
+
+// DistributionMeanAggregation builds the Aggregation that must be attached
+// to a TimeSeries.List call for any metric whose descriptor ValueType is
+// DISTRIBUTION: the API refuses to return raw distribution buckets across
+// multiple series without an explicit cross-series reducer, so this aligns
+// each series to alignmentPeriod with ALIGN_MEAN and reduces across series
+// with REDUCE_MEAN, leaving a single DOUBLE-valued point PointValue can read
+// via its DOUBLE case.
+func DistributionMeanAggregation(alignmentPeriod string) *gcm.Aggregation {
+	return &gcm.Aggregation{
+		AlignmentPeriod:    alignmentPeriod,
+		PerSeriesAligner:   "ALIGN_MEAN",
+		CrossSeriesReducer: "REDUCE_MEAN",
+	}
+}
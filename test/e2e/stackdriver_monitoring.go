@@ -25,13 +25,19 @@ import (
 	"golang.org/x/oauth2/google"
 
 	. "github.com/onsi/ginkgo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/kubernetes/test/e2e/common"
 	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/instrumentation/monitoring"
 
 	gcm "google.golang.org/api/monitoring/v3"
 )
 
+// gceZoneLabel is set by the GCE cloud provider on every Node.
+const gceZoneLabel = "topology.kubernetes.io/zone"
+
 var (
 	// Stackdriver container metrics, as descirbed here:
 	// https://cloud.google.com/monitoring/api/metrics#gcp-container
@@ -57,6 +63,13 @@ var (
 	memoryUsed        = 64
 	memoryLimit int64 = 200
 	tolerance         = 0.25
+
+	// customMetricName is the metric type the resource consumer publishes
+	// through the custom-metrics-stackdriver adapter, under the
+	// custom.googleapis.com metric domain. QPS is the fixed custom metric
+	// name ConsumeCustomMetric drives the consumer to export.
+	customMetricName  = "QPS"
+	customMetricValue = int64(448)
 )
 
 var _ = framework.KubeDescribe("Stackdriver Monitoring", func() {
@@ -79,27 +92,179 @@ var _ = framework.KubeDescribe("Stackdriver Monitoring", func() {
 
 		rc.WaitForReplicas(replicas)
 
-		pollingFunction := checkForMetrics(projectId, gcmService, time.Now())
-		framework.ExpectNoError(wait.Poll(pollFrequency, pollTimeout, pollingFunction))
+		labels, err := newMetricFilterLabels(f.ClientSet, f.Namespace.Name, rcName)
+		framework.ExpectNoError(err)
+
+		if err := monitoring.ValidateMetricDescriptors(gcmService, projectId, metricTypesOf(containerMetricsSource{})); err != nil {
+			// ExpectedSchemas hasn't been independently verified against the
+			// live API for every entry yet, so schema drift is surfaced but
+			// doesn't fail this otherwise-passing test. Promote this to
+			// framework.ExpectNoError once the table is confirmed accurate.
+			framework.Logf("metric descriptor schema validation found drift: %v", err)
+		}
+
+		start := time.Now()
+		var missing []string
+		pollingFunction := checkForMetrics(projectId, gcmService, start, containerMetricsSource{}, rcName, labels, &missing)
+		err = wait.Poll(pollFrequency, pollTimeout, pollingFunction)
+		if err != nil && len(missing) > 0 {
+			err = fmt.Errorf("%v; missing metrics: %v", err, missing)
+		}
+		framework.ExpectNoError(err)
+	})
+
+	It("should have correct custom metrics [Feature:StackdriverCustomMetrics]", func() {
+		projectId := framework.TestContext.CloudConfig.ProjectID
+
+		ctx := context.Background()
+		client, err := google.DefaultClient(ctx, gcm.CloudPlatformScope)
+		gcmService, err := gcm.New(client)
+		framework.ExpectNoError(err)
+
+		rc := common.NewDynamicResourceConsumer(rcName, common.KindDeployment, replicas, cpuUsed, memoryUsed, 0, cpuLimit, memoryLimit, f)
+		defer rc.CleanUp()
+
+		rc.WaitForReplicas(replicas)
+		rc.ConsumeCustomMetric(customMetricValue)
+
+		labels, err := newMetricFilterLabels(f.ClientSet, f.Namespace.Name, rcName)
+		framework.ExpectNoError(err)
+
+		start := time.Now()
+		var reason string
+		pollingFunction := checkForCustomMetric(projectId, gcmService, start, labels, &reason)
+		err = wait.Poll(pollFrequency, pollTimeout, pollingFunction)
+		if err != nil && reason != "" {
+			err = fmt.Errorf("%v: %s", err, reason)
+		}
+		framework.ExpectNoError(err)
 	})
 })
 
-func checkForMetrics(projectId string, gcmService *gcm.Service, start time.Time) func() (bool, error) {
+// checkForCustomMetric polls Stackdriver for the custom metric published by
+// the resource consumer through the custom-metrics-stackdriver adapter. It
+// first makes sure the metric descriptor has been created (i.e. the adapter
+// has picked up and exported the metric), then checks that the most recent
+// point falls within a plausible window of the value the consumer is
+// reporting. reason is set to the last polling failure seen, so a timeout
+// can be reported with more than just "timed out".
+func checkForCustomMetric(projectId string, gcmService *gcm.Service, start time.Time, labels metricFilterLabels, reason *string) func() (bool, error) {
+	return func() (bool, error) {
+		_, err := gcmService.Projects.MetricDescriptors.
+			Get(fullCustomMetricName(projectId, customMetricName)).
+			Do()
+		if err != nil {
+			*reason = fmt.Sprintf("metric descriptor for %q not found: %v", customMetricName, err)
+			return false, nil
+		}
+
+		ts, err := fetchTimeSeries(projectId, gcmService, createCustomMetricFilter(customMetricName, labels), start, time.Now(), nil)
+		framework.ExpectNoError(err)
+		if len(ts) == 0 {
+			*reason = fmt.Sprintf("no time series found for metric %q", customMetricName)
+			return false, nil
+		}
+
+		for _, t := range ts {
+			latest := t.Points[0]
+			latestEnd, _ := time.Parse(time.RFC3339, latest.Interval.EndTime)
+			for _, p := range t.Points {
+				pEnd, _ := time.Parse(time.RFC3339, p.Interval.EndTime)
+				if pEnd.After(latestEnd) {
+					latest = p
+					latestEnd = pEnd
+				}
+			}
+			value := float64(*latest.Value.Int64Value)
+			if math.Abs(value-float64(customMetricValue)) > tolerance*float64(customMetricValue) {
+				*reason = fmt.Sprintf("got value %v for metric %q, want within %.0f%% of %v", value, customMetricName, tolerance*100, customMetricValue)
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// metricSource abstracts over the different ingestion pipelines that can
+// deliver cluster metrics into Stackdriver, so the "should have cluster
+// metrics" test can exercise each one with the same polling logic.
+type metricSource interface {
+	// metricPrefix is the metric.type prefix metrics from this source are
+	// published under, e.g. "container.googleapis.com/container".
+	metricPrefix() string
+	// metrics are the short metric names, relative to metricPrefix, this
+	// source is expected to publish.
+	metrics() []string
+	// resourceLabelFilter builds the resource.label.* clauses identifying
+	// the cluster/location/namespace/pod a series belongs to. Label names
+	// differ by MonitoredResource type, so each source maps the common
+	// metricFilterLabels onto its own resource's label names.
+	resourceLabelFilter(labels metricFilterLabels) string
+}
+
+// containerMetricsSource is the existing kubelet->Stackdriver pipeline,
+// where cAdvisor metrics are exported as container.googleapis.com/container
+// metrics against a gke_container MonitoredResource.
+type containerMetricsSource struct{}
+
+func (containerMetricsSource) metricPrefix() string { return "container.googleapis.com/container" }
+func (containerMetricsSource) metrics() []string    { return stackdriverMetrics }
+
+// resourceLabelFilter uses gke_container's label names: zone, namespace_id
+// and pod_id, rather than the k8s_container names used elsewhere.
+func (containerMetricsSource) resourceLabelFilter(labels metricFilterLabels) string {
+	return fmt.Sprintf(`resource.label.cluster_name="%s" AND
+				resource.label.zone="%s" AND
+				resource.label.namespace_id="%s" AND
+				resource.label.pod_id="%s"`,
+		labels.clusterName, labels.location, labels.namespaceName, labels.podName)
+}
+
+// metricTypesOf returns the full metric.type strings (metricPrefix + "/" +
+// metric) a source is expected to publish.
+func metricTypesOf(source metricSource) []string {
+	metrics := source.metrics()
+	metricTypes := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		metricTypes = append(metricTypes, source.metricPrefix()+"/"+metric)
+	}
+	return metricTypes
+}
+
+func checkForMetrics(projectId string, gcmService *gcm.Service, start time.Time, source metricSource, containerName string, labels metricFilterLabels, missing *[]string) func() (bool, error) {
 	return func() (bool, error) {
-		// TODO: list which metrics are missing in case of failure
-		counter := 0
 		correctUtilization := false
-		for _, metric := range stackdriverMetrics {
-			// TODO: check only for metrics from this cluster
-			ts, err := fetchTimeSeries(projectId, gcmService, metric, start, time.Now())
+		needsUtilization := false
+		var missingMetrics []string
+		metrics := source.metrics()
+		for _, metric := range metrics {
+			if metric == "cpu/utilization" {
+				needsUtilization = true
+			}
+			metricType := source.metricPrefix() + "/" + metric
+			schema := monitoring.ExpectedSchemas[metricType]
+			var aggregation *gcm.Aggregation
+			if schema.ValueType == "DISTRIBUTION" {
+				aggregation = monitoring.DistributionMeanAggregation(fmt.Sprintf("%.0fs", pollFrequency.Seconds()))
+			}
+			ts, err := fetchTimeSeries(projectId, gcmService, createMetricFilter(metricType, containerName, source, labels), start, time.Now(), aggregation)
 			framework.ExpectNoError(err)
-			if len(ts) > 0 {
-				counter = counter + 1
+			if len(ts) == 0 {
+				missingMetrics = append(missingMetrics, metric)
 			}
+			*missing = missingMetrics
 
 			var sum float64 = 0
 			switch metric {
 			case "cpu/utilization":
+				// DistributionMeanAggregation's ALIGN_MEAN/REDUCE_MEAN
+				// collapses DISTRIBUTION points to a single DOUBLE value,
+				// so read the aggregated point back out as DOUBLE rather
+				// than the descriptor's own DISTRIBUTION ValueType.
+				valueType := schema.ValueType
+				if valueType == "DISTRIBUTION" {
+					valueType = "DOUBLE"
+				}
 				for _, t := range ts {
 					max := t.Points[0]
 					maxEnd, _ := time.Parse(time.RFC3339, max.Interval.EndTime)
@@ -110,7 +275,9 @@ func checkForMetrics(projectId string, gcmService *gcm.Service, start time.Time)
 							maxEnd, _ = time.Parse(time.RFC3339, max.Interval.EndTime)
 						}
 					}
-					sum = sum + *max.Value.DoubleValue
+					value, err := monitoring.PointValue(valueType, max)
+					framework.ExpectNoError(err)
+					sum = sum + value
 				}
 				if math.Abs(sum*float64(cpuLimit)-float64(cpuUsed)) > tolerance*float64(cpuUsed) {
 					return false, nil
@@ -119,25 +286,127 @@ func checkForMetrics(projectId string, gcmService *gcm.Service, start time.Time)
 				}
 			}
 		}
-		if counter < 9 || !correctUtilization {
+		*missing = missingMetrics
+		if len(missingMetrics) > 0 || (needsUtilization && !correctUtilization) {
 			return false, nil
 		}
 		return true, nil
 	}
 }
 
-func createMetricFilter(metric string, container_name string) string {
-	return fmt.Sprintf(`metric.type="container.googleapis.com/container/%s" AND
-				resource.label.container_name="%s"`, metric, container_name)
+// metricFilterLabels are the MonitoredResource labels identifying which
+// cluster/location/namespace/pod a metric belongs to. Scoping queries down
+// to these, in addition to resource.label.container_name, keeps parallel
+// e2e runs sharing a GCP project from reading back each other's time
+// series.
+type metricFilterLabels struct {
+	clusterName   string
+	location      string
+	namespaceName string
+	podName       string
+}
+
+// newMetricFilterLabels builds the MonitoredResource labels for the
+// resource consumer pod running in namespace, resolving the cluster's zone
+// from CloudConfig or the nodes' topology.kubernetes.io/zone label.
+func newMetricFilterLabels(c kubernetes.Interface, namespace, rcName string) (metricFilterLabels, error) {
+	if framework.TestContext.CloudConfig.Cluster == "" {
+		return metricFilterLabels{}, fmt.Errorf("CloudConfig.Cluster is empty; cannot scope the Stackdriver query to this cluster")
+	}
+	zone, err := resolveZone(c)
+	if err != nil {
+		return metricFilterLabels{}, err
+	}
+	podName, err := resolvePodName(c, namespace, rcName)
+	if err != nil {
+		return metricFilterLabels{}, err
+	}
+	return metricFilterLabels{
+		clusterName:   framework.TestContext.CloudConfig.Cluster,
+		location:      zone,
+		namespaceName: namespace,
+		podName:       podName,
+	}, nil
 }
 
-func fetchTimeSeries(projectId string, gcmService *gcm.Service, metric string, start time.Time, end time.Time) ([]*gcm.TimeSeries, error) {
-	response, err := gcmService.Projects.TimeSeries.
+// resolveZone returns the GCE zone the cluster's nodes run in. CloudConfig
+// is only guaranteed to carry a Region when the cluster spans multiple
+// zones, so fall back to the Nodes' topology.kubernetes.io/zone label. It
+// deliberately does not fall back to the GCE metadata server: that reports
+// the zone of whatever machine is running the e2e binary, which is not
+// necessarily the cluster's zone, and a wrong zone would silently scope
+// every query to the wrong resource instead of failing the test.
+func resolveZone(c kubernetes.Interface) (string, error) {
+	if framework.TestContext.CloudConfig.Zone != "" {
+		return framework.TestContext.CloudConfig.Zone, nil
+	}
+	nodes, err := c.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, node := range nodes.Items {
+		if zone, ok := node.Labels[gceZoneLabel]; ok && zone != "" {
+			return zone, nil
+		}
+	}
+	return "", fmt.Errorf("could not resolve cluster zone: CloudConfig.Zone is empty and no node has the %q label", gceZoneLabel)
+}
+
+// resolvePodName finds the single pod labeled "name": name, so the time
+// series filters can be scoped down to this test run's pod.
+func resolvePodName(c kubernetes.Interface, namespace, name string) (string, error) {
+	pods, err := c.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: fmt.Sprintf("name=%s", name)})
+	if err != nil {
+		return "", err
+	}
+	if len(pods.Items) == 0 {
+		return "", fmt.Errorf("no pods found labeled %q in namespace %q", "name="+name, namespace)
+	}
+	return pods.Items[0].Name, nil
+}
+
+// k8sContainerResourceLabelFilter uses the k8s_container MonitoredResource's
+// label names, as used by the custom-metrics adapter path.
+func k8sContainerResourceLabelFilter(labels metricFilterLabels) string {
+	return fmt.Sprintf(`resource.label.cluster_name="%s" AND
+				resource.label.location="%s" AND
+				resource.label.namespace_name="%s" AND
+				resource.label.pod_name="%s"`,
+		labels.clusterName, labels.location, labels.namespaceName, labels.podName)
+}
+
+func createMetricFilter(metricType string, container_name string, source metricSource, labels metricFilterLabels) string {
+	return fmt.Sprintf(`metric.type="%s" AND
+				resource.label.container_name="%s" AND
+				%s`, metricType, container_name, source.resourceLabelFilter(labels))
+}
+
+// createCustomMetricFilter scopes a custom.googleapis.com metric down to
+// this test's cluster/namespace/pod. Unlike createMetricFilter, it doesn't
+// add a resource.label.container_name clause: the custom-metrics-stackdriver
+// adapter publishes against a k8s_container MonitoredResource scoped to the
+// whole pod, and there's no guarantee the container name clause would match.
+func createCustomMetricFilter(metric string, labels metricFilterLabels) string {
+	return fmt.Sprintf(`metric.type="custom.googleapis.com/%s" AND
+				%s`, metric, k8sContainerResourceLabelFilter(labels))
+}
+
+// fetchTimeSeries lists the time series matching filter over [start, end].
+// aggregation may be nil; pass monitoring.DistributionMeanAggregation for
+// any metric whose descriptor ValueType is DISTRIBUTION, since the API
+// won't return raw distribution buckets across multiple series otherwise.
+func fetchTimeSeries(projectId string, gcmService *gcm.Service, filter string, start time.Time, end time.Time, aggregation *gcm.Aggregation) ([]*gcm.TimeSeries, error) {
+	call := gcmService.Projects.TimeSeries.
 		List(fullProjectName(projectId)).
-		Filter(createMetricFilter(metric, rcName)).
+		Filter(filter).
 		IntervalStartTime(start.Format(time.RFC3339)).
-		IntervalEndTime(end.Format(time.RFC3339)).
-		Do()
+		IntervalEndTime(end.Format(time.RFC3339))
+	if aggregation != nil {
+		call = call.AggregationAlignmentPeriod(aggregation.AlignmentPeriod).
+			AggregationPerSeriesAligner(aggregation.PerSeriesAligner).
+			AggregationCrossSeriesReducer(aggregation.CrossSeriesReducer)
+	}
+	response, err := call.Do()
 	if err != nil {
 		return nil, err
 	}
@@ -147,3 +416,7 @@ func fetchTimeSeries(projectId string, gcmService *gcm.Service, metric string, s
 func fullProjectName(name string) string {
 	return fmt.Sprintf("projects/%s", name)
 }
+
+func fullCustomMetricName(projectId string, metric string) string {
+	return fmt.Sprintf("projects/%s/metricDescriptors/custom.googleapis.com/%s", projectId, metric)
+}